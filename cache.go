@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/tools/go/packages"
+)
+
+var incremental = flag.Bool("incremental", false, "skip the `go install` cycle entirely when no watched package's content hash has changed since the last run")
+
+// packageCache persists the content hash of each watched package between
+// runs of rego, so that -incremental mode can tell whether a file event
+// actually changed anything a rebuild would notice (e.g. a save that
+// rewrites a file with identical bytes, or a save that touches a package
+// nothing currently depends on).
+//
+// This is deliberately narrower than a real per-package build cache: it
+// only gates whether the (unchanged) `go install <mainPkg>` step runs at
+// all, and only pays for itself on a cycle where nothing actually
+// changed. A cycle where something did change gets no speedup from this
+// package -- it pays the hashing cost on top of an ordinary full `go
+// install`, which is what does the real incremental work on that path:
+// go install already recompiles and relinks only the packages whose
+// build input (source, imports, flags) changed, via its own action-hash
+// build cache under GOCACHE. Reimplementing that selectively-recompile
+// machinery here (our own hash -> compiled-archive cache, invoking `go
+// tool compile`/`go tool link` directly per package) would duplicate
+// what the toolchain already does correctly, while risking rego
+// producing a stale binary if our cache and go's ever disagreed about
+// what changed. So rego leans on GOCACHE for that, and packageCache's
+// job stays limited to skipping the install invocation entirely when
+// hashing proves it would be a no-op.
+type packageCache struct {
+	mu     sync.Mutex
+	dir    string
+	hashes map[string]string // import path -> last-recorded content hash
+}
+
+// newPackageCache opens (creating if necessary) the on-disk cache used by
+// -incremental mode. It prefers $GOCACHE/rego, falling back to a
+// .rego-cache directory under workingDir if GOCACHE isn't set.
+func newPackageCache(workingDir string) (*packageCache, error) {
+	dir := os.Getenv("GOCACHE")
+	if dir != "" {
+		dir = filepath.Join(dir, "rego")
+	} else {
+		dir = filepath.Join(workingDir, ".rego-cache")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &packageCache{dir: dir, hashes: map[string]string{}}
+	data, err := ioutil.ReadFile(c.manifestPath())
+	if err == nil {
+		if err := json.Unmarshal(data, &c.hashes); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *packageCache) manifestPath() string {
+	return filepath.Join(c.dir, "manifest.json")
+}
+
+func (c *packageCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := json.MarshalIndent(c.hashes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.manifestPath(), data, 0644)
+}
+
+// changedPackages returns the import paths in hashes whose value differs
+// from (or is missing from) the cache.
+func (c *packageCache) changedPackages(hashes map[string]string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var changed []string
+	for imp, h := range hashes {
+		if c.hashes[imp] != h {
+			changed = append(changed, imp)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// record stores hashes as the new known-good state, to be persisted by a
+// subsequent call to save.
+func (c *packageCache) record(hashes map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for imp, h := range hashes {
+		c.hashes[imp] = h
+	}
+}
+
+// hashPackage computes a Merkle-style content hash for pkg: the sorted
+// source filenames, the SHA-256 of each source file's bytes, the resolved
+// import paths of its direct dependencies, the active build tags and
+// -race setting, and depHashes (the already-computed hashes of those
+// dependencies).
+func hashPackage(pkg *packages.Package, depHashes map[string]string, tags string, race bool) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "tags=%s race=%v\n", tags, race)
+
+	files := append(append([]string{}, pkg.GoFiles...), pkg.OtherFiles...)
+	sort.Strings(files)
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(h, "file %s %x\n", f, sum)
+	}
+
+	imports := make([]string, 0, len(pkg.Imports))
+	for imp := range pkg.Imports {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	for _, imp := range imports {
+		fmt.Fprintf(h, "import %s %s %s\n", imp, pkg.Imports[imp].PkgPath, depHashes[imp])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashPackages computes a recursive content hash for every package in
+// pkgs, folding in the hashes of direct dependencies so that a change
+// deep in the import graph invalidates every package above it. If onHash
+// is non-nil, it's called once per package with the time spent hashing
+// that package alone (for -timings' per-package breakdown).
+func hashPackages(pkgs []*packages.Package, tags string, race bool, onHash func(pkgPath string, d time.Duration)) (map[string]string, error) {
+	byImport := make(map[string]*packages.Package, len(pkgs))
+	for _, pkg := range pkgs {
+		byImport[pkg.PkgPath] = pkg
+	}
+
+	hashes := map[string]string{}
+	visiting := map[string]bool{}
+	var visit func(pkg *packages.Package) (string, error)
+	visit = func(pkg *packages.Package) (string, error) {
+		if h, ok := hashes[pkg.PkgPath]; ok {
+			return h, nil
+		}
+		if visiting[pkg.PkgPath] {
+			return "", fmt.Errorf("rego: import cycle detected at %s", pkg.PkgPath)
+		}
+		visiting[pkg.PkgPath] = true
+		defer delete(visiting, pkg.PkgPath)
+
+		depHashes := map[string]string{}
+		for imp, dep := range pkg.Imports {
+			if _, ok := byImport[dep.PkgPath]; !ok {
+				continue // stdlib or other unwatched package
+			}
+			h, err := visit(dep)
+			if err != nil {
+				return "", err
+			}
+			depHashes[imp] = h
+		}
+
+		t0 := time.Now()
+		h, err := hashPackage(pkg, depHashes, tags, race)
+		if onHash != nil {
+			onHash(pkg.PkgPath, time.Since(t0))
+		}
+		if err != nil {
+			return "", err
+		}
+		hashes[pkg.PkgPath] = h
+		return h, nil
+	}
+
+	for _, pkg := range pkgs {
+		if _, err := visit(pkg); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
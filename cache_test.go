@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func writeTestFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHashPackageChangesWithFileContents(t *testing.T) {
+	dir := t.TempDir()
+	f := writeTestFile(t, dir, "a.go", "package a\n")
+	pkg := &packages.Package{PkgPath: "a", GoFiles: []string{f}}
+
+	h1, err := hashPackage(pkg, nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := hashPackage(pkg, nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1 != h2 {
+		t.Errorf("hashPackage not deterministic: %s != %s", h1, h2)
+	}
+
+	writeTestFile(t, dir, "a.go", "package a\n\nvar x = 1\n")
+	h3, err := hashPackage(pkg, nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h3 == h1 {
+		t.Error("hashPackage didn't change after editing the file's contents")
+	}
+}
+
+func TestHashPackageChangesWithDepHash(t *testing.T) {
+	dir := t.TempDir()
+	f := writeTestFile(t, dir, "a.go", "package a\n")
+	pkg := &packages.Package{
+		PkgPath: "a",
+		GoFiles: []string{f},
+		Imports: map[string]*packages.Package{"b": {PkgPath: "b"}},
+	}
+
+	h1, err := hashPackage(pkg, map[string]string{"b": "h1"}, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := hashPackage(pkg, map[string]string{"b": "h2"}, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1 == h2 {
+		t.Error("hashPackage didn't change when a dependency's hash changed")
+	}
+}
+
+func TestHashPackageChangesWithTagsAndRace(t *testing.T) {
+	dir := t.TempDir()
+	f := writeTestFile(t, dir, "a.go", "package a\n")
+	pkg := &packages.Package{PkgPath: "a", GoFiles: []string{f}}
+
+	base, err := hashPackage(pkg, nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := hashPackage(pkg, nil, "integration", false); err != nil {
+		t.Fatal(err)
+	} else if h == base {
+		t.Error("hashPackage didn't change with different build tags")
+	}
+	if h, err := hashPackage(pkg, nil, "", true); err != nil {
+		t.Fatal(err)
+	} else if h == base {
+		t.Error("hashPackage didn't change with -race")
+	}
+}
+
+func TestChangedPackages(t *testing.T) {
+	c := &packageCache{hashes: map[string]string{"a": "h1", "b": "h2"}}
+
+	changed := c.changedPackages(map[string]string{"a": "h1", "b": "h2"})
+	if len(changed) != 0 {
+		t.Errorf("expected no changes, got %v", changed)
+	}
+
+	changed = c.changedPackages(map[string]string{"a": "h1", "b": "h3", "c": "h4"})
+	if want := []string{"b", "c"}; !stringSlicesEqual(changed, want) {
+		t.Errorf("changedPackages = %v, want %v", changed, want)
+	}
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func BenchmarkHashPackages(b *testing.B) {
+	dir := b.TempDir()
+	var pkgs []*packages.Package
+	var prev *packages.Package
+	for i := 0; i < 20; i++ {
+		name := filepath.Join(dir, "pkg"+string(rune('a'+i)))
+		if err := os.Mkdir(name, 0755); err != nil {
+			b.Fatal(err)
+		}
+		f := filepath.Join(name, "f.go")
+		if err := os.WriteFile(f, []byte("package p\n"), 0644); err != nil {
+			b.Fatal(err)
+		}
+		pkg := &packages.Package{PkgPath: name, GoFiles: []string{f}, Imports: map[string]*packages.Package{}}
+		if prev != nil {
+			pkg.Imports[prev.PkgPath] = prev
+		}
+		pkgs = append(pkgs, pkg)
+		prev = pkg
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := hashPackages(pkgs, "", false, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	preBuild  = flag.String("pre-build", "", "`cmd` to run before `go install`; aborts the build cycle on non-zero exit")
+	postBuild = flag.String("post-build", "", "`cmd` to run after a successful `go install`, before the binary is restarted")
+)
+
+// onChangeHook is one -on-change=<glob>:<cmd> flag.
+type onChangeHook struct {
+	pattern string
+	cmd     string
+}
+
+// onChangeFlags collects every -on-change flag in the order given.
+type onChangeFlags []onChangeHook
+
+func (f *onChangeFlags) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	for _, h := range *f {
+		parts = append(parts, h.pattern+":"+h.cmd)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *onChangeFlags) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return fmt.Errorf("rego: -on-change value %q must be of the form glob:cmd", value)
+	}
+	*f = append(*f, onChangeHook{pattern: value[:i], cmd: value[i+1:]})
+	return nil
+}
+
+var onChangeHooks onChangeFlags
+
+func init() {
+	flag.Var(&onChangeHooks, "on-change", "repeatable `glob:cmd` pair; cmd runs whenever a changed path matches glob, independently of the Go rebuild")
+}
+
+// matchingOnChangeHooks returns the indexes into onChangeHooks whose
+// glob matches path (tried against both the full path and the base
+// name, since most globs like "*.css" are meant to match the latter).
+func matchingOnChangeHooks(path string) []int {
+	var matched []int
+	base := filepath.Base(path)
+	for i, h := range onChangeHooks {
+		if ok, _ := filepath.Match(h.pattern, path); ok {
+			matched = append(matched, i)
+			continue
+		}
+		if ok, _ := filepath.Match(h.pattern, base); ok {
+			matched = append(matched, i)
+		}
+	}
+	return matched
+}
+
+// runHook runs command via the shell, with stdout/stderr piped through
+// the same colored status prefixes installAndRestart uses, and returns
+// any error (including a non-zero exit).
+func runHook(label, command string, env []string, workingDir string) error {
+	s := "\x1b[37;1m\x1b[44m .. \x1b[0m"
+	del := len(s)
+	fmt.Fprint(os.Stderr, s, " ", label)
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = workingDir
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if *verbose {
+		log.Println(cmd.Args)
+	}
+
+	err := cmd.Run()
+	fmt.Fprint(os.Stderr, strings.Repeat("\b", del+len(label)+1))
+	if err != nil {
+		log.Println("\x1b[37;1m\x1b[41m!!!!\x1b[0m", label, "failed:", err)
+		return err
+	}
+	log.Println("\x1b[37;1m\x1b[42m ok \x1b[0m", label)
+	return nil
+}
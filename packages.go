@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// buildFlags returns the -mod/-modfile flags shared by every `go`
+// subcommand rego shells out to (install, test, list), so that
+// -mod=vendor and -modfile keep working consistently across modes.
+func buildFlags() []string {
+	var flags []string
+	if *modFlag != "" {
+		flags = append(flags, "-mod="+*modFlag)
+	}
+	if *modFile != "" {
+		flags = append(flags, "-modfile="+*modFile)
+	}
+	return flags
+}
+
+// loadPackages resolves pkgPath to its *packages.Package using
+// golang.org/x/tools/go/packages (rather than go/build.Import, which
+// doesn't understand modules, replace directives, workspace mode, or
+// vendored trees), then walks its import graph to collect every
+// non-stdlib package it transitively depends on.
+func loadPackages(pkgPath, workingDir, tags string) (mainPkg *packages.Package, pkgs []*packages.Package, err error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps | packages.NeedModule,
+		Dir:  workingDir,
+	}
+	if tags != "" {
+		cfg.BuildFlags = append(cfg.BuildFlags, "-tags="+tags)
+	}
+	cfg.BuildFlags = append(cfg.BuildFlags, buildFlags()...)
+
+	loaded, err := packages.Load(cfg, pkgPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if packages.PrintErrors(loaded) > 0 {
+		return nil, nil, fmt.Errorf("rego: errors loading package %s", pkgPath)
+	}
+	if len(loaded) == 0 {
+		return nil, nil, fmt.Errorf("rego: no package found for %s", pkgPath)
+	}
+	mainPkg = loaded[0]
+
+	seen := map[string]bool{mainPkg.PkgPath: true}
+	pkgs = []*packages.Package{mainPkg}
+	queue := []*packages.Package{mainPkg}
+	for len(queue) > 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		for _, imp := range pkg.Imports {
+			if seen[imp.PkgPath] {
+				continue
+			}
+			seen[imp.PkgPath] = true
+			if isStdlib(imp) {
+				continue
+			}
+			pkgs = append(pkgs, imp)
+			queue = append(queue, imp)
+		}
+	}
+	return mainPkg, pkgs, nil
+}
+
+// isStdlib reports whether pkg belongs to the standard library (and so
+// shouldn't be watched for changes).
+func isStdlib(pkg *packages.Package) bool {
+	return pkg.Module == nil && !strings.Contains(pkg.PkgPath, ".")
+}
+
+// watchPaths returns the files and directories rego should watch for
+// pkg: its Go and other source files (each alongside its containing
+// directory, since w.Add on a directory doesn't pick up files created
+// later), plus its module root, so go.mod/go.sum edits and new files
+// dropped directly in the module root are noticed (the watch is not
+// recursive, so subdirectories of the root are not covered by it).
+func watchPaths(pkg *packages.Package) []string {
+	var paths []string
+	dirs := map[string]bool{}
+	addFile := func(f string) {
+		paths = append(paths, f)
+		dir := filepath.Dir(f)
+		if !dirs[dir] {
+			dirs[dir] = true
+			paths = append(paths, dir)
+		}
+	}
+	for _, f := range pkg.GoFiles {
+		addFile(f)
+	}
+	for _, f := range pkg.OtherFiles {
+		addFile(f)
+	}
+	if pkg.Module != nil && pkg.Module.Dir != "" {
+		paths = append(paths, pkg.Module.Dir)
+	}
+	return paths
+}
+
+// packageDir returns the best-effort directory for pkg, used to
+// attribute a changed file to the package that owns it.
+func packageDir(pkg *packages.Package) string {
+	if len(pkg.GoFiles) > 0 {
+		return filepath.Dir(pkg.GoFiles[0])
+	}
+	if len(pkg.OtherFiles) > 0 {
+		return filepath.Dir(pkg.OtherFiles[0])
+	}
+	if pkg.Module != nil {
+		return pkg.Module.Dir
+	}
+	return ""
+}
+
+// modFiles returns the go.mod/go.sum/go.work files whose edits should
+// trigger a full reload via loadPackages, since they can add or remove
+// dependencies that a per-package file watch wouldn't otherwise notice.
+func modFiles(mainPkg *packages.Package, workingDir string) []string {
+	var files []string
+	if mainPkg.Module != nil && mainPkg.Module.GoMod != "" {
+		files = append(files, mainPkg.Module.GoMod, filepath.Join(filepath.Dir(mainPkg.Module.GoMod), "go.sum"))
+	}
+	files = append(files, filepath.Join(workingDir, "go.work"))
+	return files
+}
+
+// isModFile reports whether path is one of the files returned by
+// modFiles, tested by base name so it matches regardless of which
+// directory in a workspace the edit came from.
+func isModFile(path string) bool {
+	switch filepath.Base(path) {
+	case "go.mod", "go.sum", "go.work":
+		return true
+	}
+	return false
+}
+
+// installTarget resolves the binary path `go install` produces for
+// mainPkg by asking the go command directly (go list -f '{{.Target}}'),
+// which is accurate under modules, whereas go/build's BinDir is not.
+func installTarget(mainPkg *packages.Package, workingDir string, env []string) (string, error) {
+	args := append([]string{"list", "-f", "{{.Target}}"}, buildFlags()...)
+	args = append(args, mainPkg.PkgPath)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = workingDir
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
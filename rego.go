@@ -3,12 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
-	"go/build"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -16,6 +16,7 @@ import (
 
 	"github.com/fsnotify/fsnotify"
 	"golang.org/x/tools/go/buildutil"
+	"golang.org/x/tools/go/packages"
 )
 
 var (
@@ -26,8 +27,53 @@ var (
 	ienv      = flag.String("installenv", "", "env vars to pass to `go install` (comma-separated: A=B,C=D)")
 	wdir      = flag.String("workdir", "", "working dir to locate the main module and run `go install`")
 	extra     = flag.String("extra-watches", "", "comma-separated path match patterns to also watch (in addition to transitive deps of Go pkg)")
+	modFlag   = flag.String("mod", "", "`mode` passed to go as -mod (e.g. vendor); also passed to go test/go list")
+	modFile   = flag.String("modfile", "", "alternate go.mod `file` passed to go as -modfile")
 )
 
+// watchState holds the package graph rego is currently watching: mainPkg
+// and pkgs as loaded by loadPackages, pkgByDir (a watched package's
+// directory -> its import path, for attributing a file event to the
+// package it belongs to), and rev (the reverse-dependency graph, for
+// -test mode's affected-set computation). reloadPackages replaces all
+// four on a go.mod/go.sum/go.work edit, and that can race with reads from
+// installAndRestart and from the per-event goroutines below (each
+// fsnotify event is handled in its own goroutine), so every access goes
+// through mu.
+type watchState struct {
+	mu       sync.Mutex
+	mainPkg  *packages.Package
+	pkgs     []*packages.Package
+	pkgByDir map[string]string
+	rev      map[string][]string
+}
+
+func newWatchState(mainPkg *packages.Package, pkgs []*packages.Package) *watchState {
+	s := &watchState{}
+	s.set(mainPkg, pkgs)
+	return s
+}
+
+// set installs mainPkg/pkgs as the current package graph and recomputes
+// pkgByDir/rev to match, atomically.
+func (s *watchState) set(mainPkg *packages.Package, pkgs []*packages.Package) {
+	pkgByDir := make(map[string]string, len(pkgs))
+	for _, pkg := range pkgs {
+		pkgByDir[packageDir(pkg)] = pkg.PkgPath
+	}
+	rev := reverseDeps(pkgs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mainPkg, s.pkgs, s.pkgByDir, s.rev = mainPkg, pkgs, pkgByDir, rev
+}
+
+func (s *watchState) get() (mainPkg *packages.Package, pkgs []*packages.Package, pkgByDir map[string]string, rev map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mainPkg, s.pkgs, s.pkgByDir, s.rev
+}
+
 func main() {
 	log.SetFlags(0)
 	flag.Parse()
@@ -55,13 +101,17 @@ func main() {
 		}
 	}
 
-	mainPkg, err := build.Import(pkgPath, workingDir, 0)
+	t0 := time.Now()
+	mainPkg, pkgs, err := loadPackages(pkgPath, workingDir, *buildTags)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *timings {
+		log.Printf("loaded %d packages in %s", len(pkgs), time.Since(t0))
+	}
 
 	if *verbose {
-		log.Printf("Watching package %s", mainPkg.ImportPath)
+		log.Printf("Watching package %s", mainPkg.PkgPath)
 	}
 
 	w, err := fsnotify.NewWatcher()
@@ -69,55 +119,34 @@ func main() {
 		log.Fatal(err)
 	}
 
-	pkgs := []*build.Package{mainPkg}
-	seenPkgs := map[string]struct{}{}
-	for i := 0; i < len(pkgs); i++ {
-		pkg := pkgs[i]
-		if pkg.Goroot {
-			continue // don't watch Go stdlib packages
-		}
-		if *verbose {
-			log.Printf("Watch %s", pkg.Dir)
-		}
-		if err := w.Add(pkg.Dir); err != nil {
-			log.Fatal(err)
+	watchedPaths := map[string]bool{}
+	addWatches := func(mainPkg *packages.Package, pkgs []*packages.Package) {
+		for _, pkg := range pkgs {
+			if *verbose {
+				log.Printf("Watch %s", packageDir(pkg))
+			}
+			for _, p := range watchPaths(pkg) {
+				if watchedPaths[p] {
+					continue
+				}
+				watchedPaths[p] = true
+				if err := w.Add(p); err != nil {
+					log.Fatal(err)
+				}
+			}
 		}
-
-		var (
-			mu sync.Mutex
-			wg sync.WaitGroup
-		)
-		for _, imp := range pkg.Imports {
-			mu.Lock()
-			_, seen := seenPkgs[imp]
-			mu.Unlock()
-			if seen {
+		for _, f := range modFiles(mainPkg, workingDir) {
+			if watchedPaths[f] {
 				continue
 			}
-
-			if imp == "C" || strings.HasPrefix(imp, ".") {
-				return
+			watchedPaths[f] = true
+			if err := w.Add(f); err != nil && *verbose {
+				log.Println(err)
 			}
-
-			wg.Add(1)
-			go func(imp string) {
-				defer wg.Done()
-				t0 := time.Now()
-				impPkg, err := build.Import(imp, workingDir, 0)
-				if err != nil {
-					log.Fatal(err)
-				}
-				if *verbose {
-					log.Printf("Import %s [%s]", imp, time.Since(t0))
-				}
-				mu.Lock()
-				defer mu.Unlock()
-				pkgs = append(pkgs, impPkg)
-				seenPkgs[imp] = struct{}{}
-			}(imp)
 		}
-		wg.Wait()
 	}
+	addWatches(mainPkg, pkgs)
+	ws := newWatchState(mainPkg, pkgs)
 
 	extraPaths := map[string]bool{}
 	if *extra != "" {
@@ -142,6 +171,27 @@ func main() {
 		}
 	}
 
+	targets, err := parseTargets(*targetsFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	runTarget, err := parseRunTarget(*runTargetFlag, targets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *verbose && len(targets) > 1 {
+		log.Printf("Targets %v, running %s locally", targets, runTarget)
+	}
+
+	targetPaths := make(map[target]string, len(targets))
+	for _, t := range targets {
+		path, err := installTarget(mainPkg, workingDir, t.env(installEnv))
+		if err != nil {
+			log.Fatal(err)
+		}
+		targetPaths[t] = path
+	}
+
 	restart := make(chan bool)
 	go func() {
 		var proc *os.Process
@@ -156,7 +206,7 @@ func main() {
 			if !alive {
 				os.Exit(0)
 			}
-			cmd := exec.Command(filepath.Join(mainPkg.BinDir, filepath.Base(mainPkg.ImportPath)), cmdArgs...)
+			cmd := exec.Command(targetPaths[runTarget], cmdArgs...)
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
 			if *verbose {
@@ -178,29 +228,83 @@ func main() {
 		}()
 	}()
 
+	var cache *packageCache
+	if *incremental {
+		cache, err = newPackageCache(workingDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	nrestarts := 0
 	installAndRestart := func() {
+		mainPkg, pkgs, _, _ := ws.get()
+
 		s := "\x1b[37;1m\x1b[44m .. \x1b[0m"
 		del := len(s)
 		fmt.Fprint(os.Stderr, s)
 
-		cmd := exec.Command("go", "install", "-tags="+*buildTags)
-		if *race {
-			cmd.Args = append(cmd.Args, "-race")
+		var newHashes map[string]string
+		if cache != nil {
+			t0 := time.Now()
+			var onHash func(string, time.Duration)
+			if *timings {
+				onHash = func(pkgPath string, d time.Duration) {
+					log.Printf("incremental: hashed %s in %s", pkgPath, d)
+				}
+			}
+			hashes, err := hashPackages(pkgs, *buildTags, *race, onHash)
+			if err != nil {
+				log.Println(err)
+			} else {
+				changed := cache.changedPackages(hashes)
+				if *timings {
+					log.Printf("incremental: hashed %d packages in %s total, %d changed", len(hashes), time.Since(t0), len(changed))
+				}
+				if len(changed) == 0 && nrestarts > 0 {
+					fmt.Fprint(os.Stderr, strings.Repeat("\b", del))
+					log.Println("\x1b[37;1m\x1b[42m ok \x1b[0m", "no changes, reusing cached build")
+					return
+				}
+				if *verbose {
+					log.Println("incremental: rebuilding", changed)
+				}
+				newHashes = hashes
+			}
 		}
-		cmd.Args = append(cmd.Args, mainPkg.ImportPath)
-		cmd.Dir = workingDir
-		cmd.Env = installEnv
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if *verbose {
-			log.Println(cmd.Args)
-			if installEnv != nil {
-				log.Println("# with env:", installEnv)
+
+		if *preBuild != "" {
+			if err := runHook("pre-build", *preBuild, installEnv, workingDir); err != nil {
+				return
 			}
 		}
+
 		start := time.Now()
-		if err := cmd.Run(); err == nil {
+		allOK := true
+		for _, t := range targets {
+			cmd := exec.Command("go", "install", "-tags="+*buildTags)
+			if *race {
+				cmd.Args = append(cmd.Args, "-race")
+			}
+			cmd.Args = append(cmd.Args, buildFlags()...)
+			cmd.Args = append(cmd.Args, mainPkg.PkgPath)
+			cmd.Dir = workingDir
+			cmd.Env = t.env(installEnv)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if *verbose {
+				log.Println(cmd.Args, "for", t)
+				if installEnv != nil {
+					log.Println("# with env:", installEnv)
+				}
+			}
+			if err := cmd.Run(); err != nil {
+				log.Println("\x1b[37;1m\x1b[41m!!!!\x1b[0m", "compilation failed for", t)
+				allOK = false
+			}
+		}
+
+		if allOK {
 			var word string
 			if nrestarts == 0 {
 				word = "starting"
@@ -213,36 +317,114 @@ func main() {
 			if *timings {
 				log.Println("compilation took", time.Since(start))
 			}
+			if *postBuild != "" {
+				if err := runHook("post-build", *postBuild, installEnv, workingDir); err != nil {
+					return
+				}
+			}
+			if newHashes != nil {
+				cache.record(newHashes)
+				if err := cache.save(); err != nil {
+					log.Println(err)
+				}
+			}
 			restart <- true
-		} else {
-			log.Println("\x1b[37;1m\x1b[41m!!!!\x1b[0m", "compilation failed")
 		}
 	}
 
-	install := make(chan struct{})
+	reloadPackages := func() {
+		newMainPkg, newPkgs, err := loadPackages(pkgPath, workingDir, *buildTags)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		addWatches(newMainPkg, newPkgs)
+		ws.set(newMainPkg, newPkgs)
+		if *verbose {
+			log.Printf("reloaded %d packages", len(newPkgs))
+		}
+	}
+
+	// install carries the import path of the package whose file changed
+	// ("" if unknown, e.g. an extra-watch path), coalesced by the 200ms
+	// debounce timer below.
+	install := make(chan string)
 	go func() {
-		needsInstall := 0
+		pending := map[string]bool{}
 		for {
 			var timerChan <-chan time.Time
-			if needsInstall > 0 {
+			if len(pending) > 0 {
 				timerChan = time.After(200 * time.Millisecond)
 			} else {
 				timerChan = make(chan time.Time) // never sent on, blocks indefinitely
 			}
 			select {
-			case <-install:
-				needsInstall++
+			case pkg := <-install:
+				if pkg != "" {
+					pending[pkg] = true
+				} else {
+					pending["*"] = true // unknown origin: treat like "everything changed"
+				}
 				continue
 			case <-timerChan:
-				needsInstall = 0
-				installAndRestart()
+				if *testMode {
+					_, pkgs, _, rev := ws.get()
+					changed := map[string]bool{}
+					if pending["*"] {
+						for _, pkg := range pkgs {
+							changed[pkg.PkgPath] = true
+						}
+					} else {
+						for pkg := range pending {
+							for _, a := range affectedSet(rev, pkg) {
+								changed[a] = true
+							}
+						}
+					}
+					var affected []string
+					for pkg := range changed {
+						affected = append(affected, pkg)
+					}
+					sort.Strings(affected)
+					affected = shardPkgs(affected, *shardIndex, *shardCount)
+					runAffectedTests(affected, workingDir, installEnv, *buildTags)
+				} else {
+					installAndRestart()
+				}
+				pending = map[string]bool{}
+			}
+		}
+	}()
+	install <- ""
+
+	// onChangeTrigger debounces -on-change hooks the same way install
+	// debounces go install: a burst of writes matching a hook's glob
+	// fires that hook exactly once, 200ms after the last matching event.
+	onChangeTrigger := make(chan int)
+	go func() {
+		pendingHooks := map[int]bool{}
+		for {
+			var timerChan <-chan time.Time
+			if len(pendingHooks) > 0 {
+				timerChan = time.After(200 * time.Millisecond)
+			} else {
+				timerChan = make(chan time.Time) // never sent on, blocks indefinitely
+			}
+			select {
+			case i := <-onChangeTrigger:
+				pendingHooks[i] = true
+			case <-timerChan:
+				for i := range pendingHooks {
+					h := onChangeHooks[i]
+					go runHook("on-change "+h.pattern, h.cmd, installEnv, workingDir)
+				}
+				pendingHooks = map[int]bool{}
 			}
 		}
 	}()
-	install <- struct{}{}
 
 	matchFile := func(name string) bool {
-		return (filepath.Ext(name) == ".go" && !strings.HasPrefix(filepath.Base(name), ".")) || extraPaths[name]
+		return (filepath.Ext(name) == ".go" && !strings.HasPrefix(filepath.Base(name), ".")) || extraPaths[name] || isModFile(name)
 	}
 
 	for {
@@ -308,7 +490,14 @@ func main() {
 				if *verbose {
 					log.Println(ev)
 				}
-				install <- struct{}{}
+				if isModFile(ev.Name) {
+					reloadPackages()
+				}
+				for _, i := range matchingOnChangeHooks(ev.Name) {
+					onChangeTrigger <- i
+				}
+				_, _, pkgByDir, _ := ws.get()
+				install <- pkgByDir[filepath.Dir(ev.Name)]
 			}()
 		case err, ok := <-w.Errors:
 			if !ok {
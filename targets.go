@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+var (
+	targetsFlag   = flag.String("targets", "", "comma-separated `goos/goarch` pairs to build on every change (e.g. linux/amd64,linux/arm64,darwin/arm64); defaults to the host's GOOS/GOARCH")
+	runTargetFlag = flag.String("run-target", "", "which built `goos/goarch` target to exec locally; defaults to the host's GOOS/GOARCH if it's among -targets, else the first target")
+)
+
+// target is one GOOS/GOARCH pair from -targets.
+type target struct {
+	goos, goarch string
+}
+
+func (t target) String() string {
+	return t.goos + "/" + t.goarch
+}
+
+// env returns installEnv with GOOS/GOARCH set to t, so `go install`
+// cross-compiles for this target. installEnv is nil unless -installenv
+// was given (in which case it already starts from os.Environ()), so nil
+// is expanded to os.Environ() here too -- otherwise the returned slice
+// would contain only the two GOOS/GOARCH entries and replace the
+// inherited environment instead of overlaying it.
+func (t target) env(installEnv []string) []string {
+	base := installEnv
+	if base == nil {
+		base = os.Environ()
+	}
+	env := append([]string{}, base...)
+	return append(env, "GOOS="+t.goos, "GOARCH="+t.goarch)
+}
+
+func hostTarget() target {
+	return target{goos: runtime.GOOS, goarch: runtime.GOARCH}
+}
+
+// parseTargets parses -targets, defaulting to a single host target so
+// the rest of rego can always operate on a target list, whether or not
+// -targets was given.
+func parseTargets(s string) ([]target, error) {
+	if s == "" {
+		return []target{hostTarget()}, nil
+	}
+	var targets []target
+	for _, part := range strings.Split(s, ",") {
+		i := strings.Index(part, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("rego: -targets entry %q must be of the form goos/goarch", part)
+		}
+		targets = append(targets, target{goos: part[:i], goarch: part[i+1:]})
+	}
+	return targets, nil
+}
+
+// parseRunTarget resolves -run-target against targets.
+func parseRunTarget(s string, targets []target) (target, error) {
+	if s == "" {
+		host := hostTarget()
+		for _, t := range targets {
+			if t == host {
+				return host, nil
+			}
+		}
+		return targets[0], nil
+	}
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return target{}, fmt.Errorf("rego: -run-target %q must be of the form goos/goarch", s)
+	}
+	want := target{goos: s[:i], goarch: s[i+1:]}
+	for _, t := range targets {
+		if t == want {
+			return want, nil
+		}
+	}
+	return target{}, fmt.Errorf("rego: -run-target %s is not among -targets %v", s, targets)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTargets(t *testing.T) {
+	if got, err := parseTargets(""); err != nil {
+		t.Fatal(err)
+	} else if want := []target{hostTarget()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTargets(\"\") = %v, want %v", got, want)
+	}
+
+	got, err := parseTargets("linux/amd64,darwin/arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []target{{goos: "linux", goarch: "amd64"}, {goos: "darwin", goarch: "arm64"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTargets(...) = %v, want %v", got, want)
+	}
+
+	if _, err := parseTargets("linux"); err == nil {
+		t.Error("parseTargets(\"linux\") should have failed without a goarch")
+	}
+}
+
+func TestParseRunTarget(t *testing.T) {
+	targets := []target{{goos: "linux", goarch: "amd64"}, {goos: "darwin", goarch: "arm64"}}
+
+	got, err := parseRunTarget("darwin/arm64", targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (target{goos: "darwin", goarch: "arm64"}); got != want {
+		t.Errorf("parseRunTarget(explicit) = %v, want %v", got, want)
+	}
+
+	if _, err := parseRunTarget("windows/386", targets); err == nil {
+		t.Error("parseRunTarget should fail for a target not in -targets")
+	}
+
+	// A target list that can't contain the test host falls back to its
+	// first entry.
+	fallback := []target{{goos: "plan9", goarch: "386"}, {goos: "js", goarch: "wasm"}}
+	got, err = parseRunTarget("", fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fallback[0]; got != want {
+		t.Errorf("parseRunTarget(\"\") = %v, want %v", got, want)
+	}
+
+	if got, err := parseRunTarget("", []target{hostTarget(), {goos: "js", goarch: "wasm"}}); err != nil {
+		t.Fatal(err)
+	} else if want := hostTarget(); got != want {
+		t.Errorf("parseRunTarget(\"\") should prefer the host target, got %v want %v", got, want)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+var (
+	testMode    = flag.Bool("test", false, "run `go test` on the affected package set on every change, instead of installing and restarting a binary")
+	testWorkers = flag.Int("n", runtime.NumCPU(), "number of parallel test workers (-test mode)")
+	shardIndex  = flag.Int("shard", 0, "this machine's 0-based shard index (-test mode)")
+	shardCount  = flag.Int("shards", 1, "total number of shards the affected package set is split across (-test mode)")
+	testSummary = flag.Bool("summary", false, "print a pass/fail/skip summary table after each test run (-test mode)")
+	showSkips   = flag.Bool("show-skips", false, "include skipped tests by name in the -summary table (-test mode)")
+	runSkips    = flag.String("run-skips", "", "extra `tags` passed to `go test` to force-run tests that would otherwise be skipped (-test mode)")
+)
+
+// reverseDeps maps each watched package's import path to the import
+// paths of the watched packages that directly import it.
+func reverseDeps(pkgs []*packages.Package) map[string][]string {
+	byImport := make(map[string]*packages.Package, len(pkgs))
+	for _, pkg := range pkgs {
+		byImport[pkg.PkgPath] = pkg
+	}
+	rev := map[string][]string{}
+	for _, pkg := range pkgs {
+		for _, imp := range pkg.Imports {
+			if _, ok := byImport[imp.PkgPath]; ok {
+				rev[imp.PkgPath] = append(rev[imp.PkgPath], pkg.PkgPath)
+			}
+		}
+	}
+	return rev
+}
+
+// affectedSet returns changedPkg plus every watched package that
+// transitively imports it (its reverse-dependency closure).
+func affectedSet(rev map[string][]string, changedPkg string) []string {
+	seen := map[string]bool{changedPkg: true}
+	queue := []string{changedPkg}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, importer := range rev[p] {
+			if !seen[importer] {
+				seen[importer] = true
+				queue = append(queue, importer)
+			}
+		}
+	}
+	affected := make([]string, 0, len(seen))
+	for p := range seen {
+		affected = append(affected, p)
+	}
+	sort.Strings(affected)
+	return affected
+}
+
+// shardPkgs returns the subset of pkgs assigned to shard index out of
+// count shards, distributed round-robin over the (already sorted) list
+// so shards stay balanced as the affected set grows or shrinks.
+func shardPkgs(pkgs []string, index, count int) []string {
+	if count <= 1 {
+		return pkgs
+	}
+	var out []string
+	for i, p := range pkgs {
+		if i%count == index {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+type testOutcome struct {
+	pkg     string
+	ok      bool
+	passed  []string
+	failed  []string
+	skipped []string
+	runErr  error
+}
+
+var testResultLineRe = regexp.MustCompile(`^--- (PASS|FAIL|SKIP): (\S+)`)
+
+// runAffectedTests runs `go test` for pkgs (already sharded to this
+// machine's share), *testWorkers at a time, streaming each package's
+// output through a "[pkg] " prefix, then prints a -summary table if
+// requested.
+func runAffectedTests(pkgs []string, workingDir string, env []string, tags string) {
+	if len(pkgs) == 0 {
+		return
+	}
+
+	work := make(chan string)
+	results := make(chan testOutcome, len(pkgs))
+	var wg sync.WaitGroup
+	workers := *testWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pkg := range work {
+				results <- runPackageTest(pkg, workingDir, env, tags)
+			}
+		}()
+	}
+	go func() {
+		for _, pkg := range pkgs {
+			work <- pkg
+		}
+		close(work)
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var all []testOutcome
+	for r := range results {
+		all = append(all, r)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].pkg < all[j].pkg })
+
+	if *testSummary {
+		printTestSummary(all)
+	}
+}
+
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	buf    bytes.Buffer
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf.Write(data)
+	for {
+		line, err := p.buf.ReadString('\n')
+		if err != nil {
+			// Incomplete line; put it back for the next Write.
+			p.buf.Reset()
+			p.buf.WriteString(line)
+			break
+		}
+		fmt.Fprintf(p.w, "[%s] %s", p.prefix, line)
+	}
+	return len(data), nil
+}
+
+func runPackageTest(pkg, workingDir string, env []string, tags string) testOutcome {
+	allTags := tags
+	if *runSkips != "" {
+		if allTags != "" {
+			allTags += ","
+		}
+		allTags += *runSkips
+	}
+
+	args := append([]string{"test", "-v", "-tags=" + allTags}, buildFlags()...)
+	args = append(args, pkg)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = workingDir
+	cmd.Env = env
+
+	var captured bytes.Buffer
+	out := &prefixWriter{prefix: pkg, w: os.Stdout}
+	cmd.Stdout = io.MultiWriter(out, &captured)
+	cmd.Stderr = io.MultiWriter(out, &captured)
+
+	runErr := cmd.Run()
+
+	outcome := testOutcome{pkg: pkg, ok: runErr == nil, runErr: runErrOrNil(runErr)}
+	scanner := bufio.NewScanner(&captured)
+	for scanner.Scan() {
+		m := testResultLineRe.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		switch m[1] {
+		case "PASS":
+			outcome.passed = append(outcome.passed, m[2])
+		case "FAIL":
+			outcome.failed = append(outcome.failed, m[2])
+		case "SKIP":
+			outcome.skipped = append(outcome.skipped, m[2])
+		}
+	}
+	return outcome
+}
+
+// runErrOrNil suppresses *exec.ExitError, which means `go test` exited
+// non-zero (a failing test, or a package that didn't build); that is
+// already reflected in outcome.ok.
+func runErrOrNil(err error) error {
+	if _, ok := err.(*exec.ExitError); ok {
+		return nil
+	}
+	return err
+}
+
+func printTestSummary(all []testOutcome) {
+	var npass, nfail, nskip int
+	log.Println("\x1b[37;1m== test summary ==\x1b[0m")
+	for _, o := range all {
+		npass += len(o.passed)
+		nfail += len(o.failed)
+		nskip += len(o.skipped)
+
+		status := "\x1b[37;1m\x1b[42m ok \x1b[0m"
+		if !o.ok || len(o.failed) > 0 {
+			status = "\x1b[37;1m\x1b[41mFAIL\x1b[0m"
+		}
+		log.Printf("%s %s (%d pass, %d fail, %d skip)", status, o.pkg, len(o.passed), len(o.failed), len(o.skipped))
+		if o.runErr != nil {
+			log.Println("   ", o.runErr)
+		}
+		for _, name := range o.failed {
+			log.Println("    FAIL", name)
+		}
+		if *showSkips {
+			for _, name := range o.skipped {
+				log.Println("    SKIP", name)
+			}
+		}
+	}
+	log.Printf("%d passed, %d failed, %d skipped across %d package(s)", npass, nfail, nskip, len(all))
+}
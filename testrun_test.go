@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestShardPkgs(t *testing.T) {
+	pkgs := []string{"a", "b", "c", "d", "e"}
+
+	if got := shardPkgs(pkgs, 0, 1); !reflect.DeepEqual(got, pkgs) {
+		t.Errorf("shardPkgs with 1 shard = %v, want %v (unchanged)", got, pkgs)
+	}
+
+	tests := []struct {
+		index, count int
+		want         []string
+	}{
+		{0, 2, []string{"a", "c", "e"}},
+		{1, 2, []string{"b", "d"}},
+	}
+	for _, tc := range tests {
+		got := shardPkgs(pkgs, tc.index, tc.count)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("shardPkgs(%v, %d, %d) = %v, want %v", pkgs, tc.index, tc.count, got, tc.want)
+		}
+	}
+
+	var allShards []string
+	for i := 0; i < 3; i++ {
+		allShards = append(allShards, shardPkgs(pkgs, i, 3)...)
+	}
+	if len(allShards) != len(pkgs) {
+		t.Errorf("sharding across all indexes dropped or duplicated packages: got %v from %v", allShards, pkgs)
+	}
+}
+
+func TestAffectedSet(t *testing.T) {
+	// a <- b <- c  (c imports b imports a)
+	//      \-- d
+	rev := map[string][]string{
+		"a": {"b"},
+		"b": {"c", "d"},
+	}
+
+	got := affectedSet(rev, "a")
+	want := []string{"a", "b", "c", "d"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("affectedSet(rev, %q) = %v, want %v", "a", got, want)
+	}
+
+	got = affectedSet(rev, "c")
+	want = []string{"c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("affectedSet(rev, %q) = %v, want %v", "c", got, want)
+	}
+}
+
+func TestReverseDeps(t *testing.T) {
+	a := &packages.Package{PkgPath: "a"}
+	b := &packages.Package{PkgPath: "b", Imports: map[string]*packages.Package{"a": a}}
+	c := &packages.Package{PkgPath: "c", Imports: map[string]*packages.Package{"a": a, "b": b}}
+
+	rev := reverseDeps([]*packages.Package{a, b, c})
+	for _, importers := range rev {
+		sort.Strings(importers)
+	}
+
+	want := map[string][]string{
+		"a": {"b", "c"},
+		"b": {"c"},
+	}
+	if !reflect.DeepEqual(rev, want) {
+		t.Errorf("reverseDeps = %v, want %v", rev, want)
+	}
+}